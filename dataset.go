@@ -0,0 +1,178 @@
+// Copyright (C) 2015-2017 Mikael Berthe <mikael@lilotux.net>. All rights reserved.
+// Use of this source code is governed by the MIT license,
+// which can be found in the LICENSE file.
+
+package main
+
+import "time"
+
+// FilterSpec describes a set of filtering criteria that can be applied
+// to a Dataset.  It mirrors the CLI date/time/limit flags so the same
+// filtering logic can be driven from the command line or from HTTP query
+// parameters.
+type FilterSpec struct {
+	FromDate time.Time
+	ToDate   time.Time
+
+	FromTime    simpleTime
+	HasFromTime bool
+	ToTime      simpleTime
+	HasToTime   bool
+
+	Limit uint
+}
+
+// WHOStatsResult holds the per-class breakdown computed by
+// Dataset.WHOStats.
+type WHOStatsResult struct {
+	AverageRaw   float64
+	AverageClass int
+	Counts       map[int]int
+	Total        int
+}
+
+// filterByUser returns the subset of items belonging to the given user.
+func filterByUser(items []measurement, user int) []measurement {
+	var out []measurement
+	for _, m := range items {
+		if m.User == user {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Dataset wraps a slice of measurements, sorted from the most recent to
+// the oldest, and provides the filtering and statistics operations
+// shared by the CLI and the HTTP server.
+type Dataset struct {
+	items []measurement
+}
+
+// NewDataset returns a Dataset wrapping the given items.
+func NewDataset(items []measurement) *Dataset {
+	return &Dataset{items: items}
+}
+
+// Items returns the measurements currently held by the Dataset.
+func (d *Dataset) Items() []measurement {
+	return d.items
+}
+
+// dateOf returns the time.Time corresponding to a measurement's
+// timestamp fields.
+func dateOf(m measurement) time.Time {
+	return time.Date(m.Year, time.Month(m.Month), m.Day, m.Hour, m.Minute,
+		0, 0, time.Local)
+}
+
+// Filter returns a new Dataset containing only the measurements matching
+// spec.  Items are assumed to be sorted from the most recent to the
+// oldest, as produced by mergeItems.
+func (d *Dataset) Filter(spec FilterSpec) *Dataset {
+	items := d.items
+
+	if !spec.FromDate.IsZero() {
+		for i := range items {
+			if dateOf(items[i]).Sub(spec.FromDate) < 0 {
+				items = items[0:i]
+				break
+			}
+		}
+	}
+
+	if !spec.ToDate.IsZero() {
+		cut := len(items)
+		for i := range items {
+			if dateOf(items[i]).Sub(spec.ToDate) <= 0 {
+				cut = i
+				break
+			}
+		}
+		items = items[cut:]
+	}
+
+	if spec.HasFromTime || spec.HasToTime {
+		compare := func(m measurement, t simpleTime) int {
+			if m.Hour*60+m.Minute < t.hour*60+t.minute {
+				return -1
+			}
+			if m.Hour*60+m.Minute > t.hour*60+t.minute {
+				return 1
+			}
+			return 0
+		}
+
+		inv := spec.HasFromTime && spec.HasToTime &&
+			spec.FromTime.hour*60+spec.FromTime.minute >
+				spec.ToTime.hour*60+spec.ToTime.minute
+
+		var newItems []measurement
+		for _, data := range items {
+			if inv {
+				if compare(data, spec.FromTime) == -1 && compare(data, spec.ToTime) == 1 {
+					continue
+				}
+				newItems = append(newItems, data)
+				continue
+			}
+			if spec.HasFromTime && compare(data, spec.FromTime) == -1 {
+				continue
+			}
+			if spec.HasToTime && compare(data, spec.ToTime) == 1 {
+				continue
+			}
+			newItems = append(newItems, data)
+		}
+		items = newItems
+	}
+
+	if spec.Limit > 0 && len(items) > int(spec.Limit) {
+		items = items[0:spec.Limit]
+	}
+
+	return &Dataset{items: items}
+}
+
+// Average returns the average of the Dataset's measurements.
+func (d *Dataset) Average() (measurement, error) {
+	return average(d.items)
+}
+
+// Median returns the median of the Dataset's measurements.
+func (d *Dataset) Median() (measurement, error) {
+	return median(d.items)
+}
+
+// StdDeviation returns the standard deviation of the Dataset's
+// measurements.
+func (d *Dataset) StdDeviation() (measurement, error) {
+	return stdDeviation(d.items)
+}
+
+// WHOStats returns the WHO blood pressure classification breakdown of
+// the Dataset's measurements.
+func (d *Dataset) WHOStats() WHOStatsResult {
+	sum := 0.0
+	classes := make(map[int]int)
+	for _, m := range d.items {
+		s, flag := m.WHOClass()
+		classes[s]++
+		sum += float64(s)
+		if flag == IsolatedSystolicHypertension {
+			sum += 0.5
+		}
+	}
+
+	var avg float64
+	if len(d.items) > 0 {
+		avg = sum / float64(len(d.items))
+	}
+
+	return WHOStatsResult{
+		AverageRaw:   avg,
+		AverageClass: int(0.5 + avg),
+		Counts:       classes,
+		Total:        len(d.items),
+	}
+}
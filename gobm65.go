@@ -53,6 +53,19 @@ package main
 //
 // Data from several JSON files can be merged, files are separated with a ';':
 // % gobm65 -i "data_u0.json;data_u1.json;data_u2.json"
+//
+// Archive the records in an RRD file for long-term storage (an RRD has
+// a single series, so --user must select one specific user):
+// % gobm65 --user 1 --rrd bp_u1.rrd
+// ... and render a graph of the last month from it:
+// % gobm65 --user 1 --rrd bp_u1.rrd --rrd-graph bp_u1.png
+//
+// Run as an HTTP server exposing /records, /stats and /metrics, polling
+// the device every 10 minutes:
+// % gobm65 --serve :8065 --poll-interval 10m
+//
+// The BM65 stores records for two users; select one of them explicitly:
+// % gobm65 --user 2 --stats
 
 import (
 	"encoding/json"
@@ -63,11 +76,14 @@ import (
 	"math"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	flag "github.com/spf13/pflag"
 	"github.com/tarm/serial"
+
+	"hg.lilotux.net/golang/mikael/gobm65/storage"
 )
 
 type measurement struct {
@@ -80,6 +96,7 @@ type measurement struct {
 	Hour      int
 	Minute    int
 	Year      int
+	User      int
 }
 
 type simpleTime struct {
@@ -134,7 +151,11 @@ func getData(s io.ReadWriteCloser, buf []byte, size int) (int, error) {
 	return t, nil
 }
 
-func fetchData(dev string) (items []measurement, err error) {
+// fetchData reads the measurements stored on the device for the given
+// user slots (1 and/or 2).  No bank is selected for the first user in
+// users: the records of the device's active bank are read and tagged
+// with that user, whichever bank is active.
+func fetchData(dev string, users []int) (items []measurement, err error) {
 	c := &serial.Config{Name: dev, Baud: 4800}
 
 	var s *serial.Port
@@ -177,66 +198,123 @@ func fetchData(dev string) (items []measurement, err error) {
 	n, err = getData(s, buf, 32)
 	log.Printf("DESC> %q\n", buf[:n])
 
-	// =================== Count =====================
-	q = []byte("\xa2")
-	//log.Printf("Query: %q\n", q)
-	log.Println("Requesting data counter...")
-	n, err = s.Write(q)
-	if err != nil {
-		return items, err
-	}
+	// =================== Users =====================
+	for ui, user := range users {
+		// Select user bank.  NOTE: unlike the handshake/desc/count/record
+		// opcodes above, this select-user opcode (and its one-byte ack)
+		// is not documented in atbrask's protocol write-up; it has not
+		// been verified against real hardware.  To keep the well-tested
+		// single-bank read working, we never select a bank for the
+		// first requested user (the device's active bank, exactly as
+		// before multi-user support existed), and a select failure on
+		// any later user is treated as non-fatal: we keep the records
+		// gathered so far instead of failing the whole fetch.
+		if ui > 0 {
+			q = []byte{'\xa5', uint8(user)}
+			//log.Printf("Query: %q\n", q)
+			log.Printf("Selecting user %d...", user)
+			if _, err = s.Write(q); err != nil {
+				return items, err
+			}
 
-	n, err = getData(s, buf, 1)
-	if err != nil {
-		return items, err
-	}
-	var nRecords int
-	if n == 1 {
-		log.Printf("%d item(s) available.", buf[0])
-		nRecords = int(buf[0])
-	} else {
-		log.Printf("(%d bytes) %q\n", n, buf[:n])
-		return items, fmt.Errorf("no measurement found")
-	}
+			n, ackErr := getData(s, buf, 1)
+			if ackErr != nil || n != 1 || buf[0] != '\x55' {
+				log.Printf("Could not select user %d, skipping it (select-user opcode is unverified): %v", user, ackErr)
+				break
+			}
+		}
 
-	// =================== Records =====================
-	for i := 0; i < nRecords; i++ {
-		q = []byte{'\xa3', uint8(i + 1)}
+		// =================== Count =====================
+		q = []byte("\xa2")
 		//log.Printf("Query: %q\n", q)
-		//log.Printf("Requesting measurement %d...", i+1)
+		log.Println("Requesting data counter...")
 		n, err = s.Write(q)
 		if err != nil {
 			return items, err
 		}
 
-		n, err = getData(s, buf, 9)
-		//log.Printf("DESC> %q\n", buf[:n])
+		n, err = getData(s, buf, 1)
+		if err != nil {
+			return items, err
+		}
+		var nRecords int
+		if n == 1 {
+			log.Printf("%d item(s) available for user %d.", buf[0], user)
+			nRecords = int(buf[0])
+		} else {
+			log.Printf("(%d bytes) %q\n", n, buf[:n])
+			return items, fmt.Errorf("no measurement found for user %d", user)
+		}
 
-		var data measurement
-		data.Header = int(buf[0])
-		data.Systolic = int(buf[1]) + 25
-		data.Diastolic = int(buf[2]) + 25
-		data.Pulse = int(buf[3])
-		data.Month = int(buf[4])
-		data.Day = int(buf[5])
-		data.Hour = int(buf[6])
-		data.Minute = int(buf[7])
-		data.Year = int(buf[8]) + 2000
-		items = append(items, data)
+		// =================== Records =====================
+		for i := 0; i < nRecords; i++ {
+			q = []byte{'\xa3', uint8(i + 1)}
+			//log.Printf("Query: %q\n", q)
+			//log.Printf("Requesting measurement %d...", i+1)
+			n, err = s.Write(q)
+			if err != nil {
+				return items, err
+			}
+
+			n, err = getData(s, buf, 9)
+			//log.Printf("DESC> %q\n", buf[:n])
+
+			var data measurement
+			data.Header = int(buf[0])
+			data.Systolic = int(buf[1]) + 25
+			data.Diastolic = int(buf[2]) + 25
+			data.Pulse = int(buf[3])
+			data.Month = int(buf[4])
+			data.Day = int(buf[5])
+			data.Hour = int(buf[6])
+			data.Minute = int(buf[7])
+			data.Year = int(buf[8]) + 2000
+			data.User = user
+			items = append(items, data)
+		}
 	}
 
 	s.Close()
 	return mergeItems(items, []measurement{}), nil
 }
 
+// jsonFileVersion is the current version of the JSON archive envelope
+// written by this tool.
+const jsonFileVersion = 2
+
+// jsonFile is the versioned envelope used to store measurements to a
+// JSON file since jsonFileVersion 2.
+type jsonFile struct {
+	Version int           `json:"version"`
+	Records []measurement `json:"records"`
+}
+
+// decodeJSONRecords decodes a JSON archive, handling both the current
+// versioned envelope and legacy (version 1) files, which are bare
+// arrays of measurements all belonging to user 1.
+func decodeJSONRecords(data []byte) (items []measurement, err error) {
+	var f jsonFile
+	if err = json.Unmarshal(data, &f); err == nil && f.Version > 0 {
+		return f.Records, nil
+	}
+
+	if err = json.Unmarshal(data, &items); err != nil {
+		return items, err
+	}
+	for i := range items {
+		items[i].User = 1
+	}
+	return items, nil
+}
+
+// loadFromJSONFile reads and decodes a JSON archive file.
 func loadFromJSONFile(filename string) (items []measurement, err error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return items, err
 	}
 
-	err = json.Unmarshal(data, &items)
-	return items, err
+	return decodeJSONRecords(data)
 }
 
 func loadFromJSONFiles(files string) (items []measurement, err error) {
@@ -294,6 +372,15 @@ func mergeItems(newItems, oldItems []measurement) []measurement {
 		return isLater(newItems[i], newItems[j])
 	})
 
+	// sameRecord reports whether mi and mj are the same record, using
+	// (User, timestamp) as the dedup key so that archives from
+	// different users are never collapsed into one another.
+	sameRecord := func(mi, mj measurement) bool {
+		return mi.User == mj.User &&
+			mi.Year == mj.Year && mi.Month == mj.Month && mi.Day == mj.Day &&
+			mi.Hour == mj.Hour && mi.Minute == mj.Minute
+	}
+
 	// insertIfMissing inserts a measurement into a sorted slice
 	insertIfMissing := func(l []measurement, m measurement) []measurement {
 		var later bool
@@ -303,7 +390,7 @@ func mergeItems(newItems, oldItems []measurement) []measurement {
 			if !later {
 				break
 			}
-			if l[i] == m { // Duplicate
+			if sameRecord(l[i], m) { // Duplicate
 				return l
 			}
 		}
@@ -490,26 +577,66 @@ func (m measurement) WHOClassString() string {
 	return WHOPressureClassification[class] + flagStr
 }
 
-func displayWHOClassStats(items []measurement) {
-	sum := 0.0
-	classes := make(map[int]int)
-	for _, m := range items {
-		s, flag := m.WHOClass()
-		classes[s]++
-		sum += float64(s)
-		if flag == IsolatedSystolicHypertension {
-			sum += 0.5
-		}
-	}
-
-	avg := sum / float64(len(items))
+func displayWHOClassStats(stats WHOStatsResult) {
 	fmt.Fprintf(os.Stderr, "Average WHO classification: %s (%.2f)\n",
-		WHOPressureClassification[int(0.5+avg)], avg)
+		WHOPressureClassification[stats.AverageClass], stats.AverageRaw)
 
 	for c := range WHOPressureClassification {
 		fmt.Fprintf(os.Stderr, " . %21s: %3d (%d%%)\n",
-			WHOPressureClassification[c], classes[c],
-			classes[c]*100/len(items))
+			WHOPressureClassification[c], stats.Counts[c],
+			stats.Counts[c]*100/stats.Total)
+	}
+}
+
+// displayPerUserStats prints separate averages, medians and (optionally)
+// WHO classification distributions for users 1 and 2, skipping a user
+// with no record in items.  Records of any other user are not shown.
+func displayPerUserStats(items []measurement, whoClass bool) {
+	for _, user := range []int{1, 2} {
+		userItems := filterByUser(items, user)
+		if len(userItems) == 0 {
+			continue
+		}
+
+		ds := NewDataset(userItems)
+		fmt.Fprintf(os.Stderr, "--- User %d ---\n", user)
+
+		if avgMeasure, err := ds.Average(); err != nil {
+			log.Println("Error:", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Average: %d;%d;%d\n",
+				avgMeasure.Systolic, avgMeasure.Diastolic, avgMeasure.Pulse)
+		}
+
+		if len(userItems) > 0 {
+			if m, err := ds.Median(); err != nil {
+				log.Println("Error:", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Median values: %d;%d;%d\n",
+					m.Systolic, m.Diastolic, m.Pulse)
+			}
+		}
+
+		if whoClass {
+			displayWHOClassStats(ds.WHOStats())
+		}
+	}
+}
+
+// writeCSV writes items to w in the tool's semicolon-separated format,
+// optionally appending the WHO classification of each record.  It is
+// shared by the CLI and the HTTP server's /records.csv endpoint.
+func writeCSV(w io.Writer, items []measurement, whoClass bool) {
+	for i, data := range items {
+		fmt.Fprintf(w, "%d;%x;%d-%02d-%02d %02d:%02d;%d;%d;%d",
+			i+1, data.Header,
+			data.Year, data.Month, data.Day,
+			data.Hour, data.Minute,
+			data.Systolic, data.Diastolic, data.Pulse)
+		if whoClass {
+			fmt.Fprintf(w, ";%s", data.WHOClassString())
+		}
+		fmt.Fprintln(w)
 	}
 }
 
@@ -527,6 +654,11 @@ func main() {
 	device := flag.StringP("device", "d", "/dev/ttyUSB0", "Serial device")
 	fromTime := flag.String("from-time", "", "Select records after time (HH:MM)")
 	toTime := flag.String("to-time", "", "Select records bofore time (HH:MM)")
+	rrdFile := flag.String("rrd", "", "Store records in the given RRD file")
+	rrdGraph := flag.String("rrd-graph", "", "Render a PNG graph from the RRD file given with --rrd")
+	serveAddr := flag.String("serve", "", "Run as an HTTP server on the given address (e.g. :8065) instead of exiting after one read")
+	pollInterval := flag.Duration("poll-interval", 5*time.Minute, "Polling interval for the device in --serve mode")
+	userFlag := flag.String("user", "all", "Select the BM65 user profile: 1, 2 or all")
 
 	flag.StringVar(fromDate, "since", "", "Same as --from-date")
 
@@ -546,6 +678,22 @@ func main() {
 		log.Fatal("Unknown output format.  Possible choices are csv, json.")
 	}
 
+	var fetchUsers []int
+	switch *userFlag {
+	case "all", "":
+		fetchUsers = []int{1, 2}
+	case "1":
+		fetchUsers = []int{1}
+	case "2":
+		fetchUsers = []int{2}
+	default:
+		log.Fatal("Invalid --user value.  Possible choices are 1, 2, all.")
+	}
+
+	if *rrdFile != "" && *userFlag == "all" {
+		log.Fatal("--rrd requires a single --user (1 or 2): an RRD has one systolic/diastolic/pulse series and cannot mix both users' readings.")
+	}
+
 	if *fromTime != "" {
 		if t, err := parseTime(*fromTime); err != nil {
 			log.Fatal("Cannot parse 'from' time: ", err)
@@ -571,13 +719,18 @@ func main() {
 		log.Fatal("Could not parse date: ", err)
 	}
 
+	if *serveAddr != "" {
+		runServer(*serveAddr, *device, *inFile, *pollInterval)
+		return
+	}
+
 	var items []measurement
 
 	// Read data
 
 	if *inFile == "" {
 		// Read from device
-		if items, err = fetchData(*device); err != nil {
+		if items, err = fetchData(*device, fetchUsers); err != nil {
 			log.Fatal(err)
 		}
 	} else {
@@ -587,7 +740,7 @@ func main() {
 			log.Fatal(err)
 		}
 		if *merge {
-			if items, err = fetchData(*device); err != nil {
+			if items, err = fetchData(*device, fetchUsers); err != nil {
 				log.Fatal(err)
 			}
 			items = mergeItems(items, fileItems)
@@ -596,91 +749,28 @@ func main() {
 		}
 	}
 
-	// Apply filters
-
-	if !startDate.IsZero() {
-		log.Printf("Filtering out records before %v...\n", startDate)
-		for i := range items {
-			iDate := time.Date(items[i].Year, time.Month(items[i].Month),
-				items[i].Day, items[i].Hour, items[i].Minute, 0, 0,
-				time.Local)
-			if iDate.Sub(startDate) < 0 {
-				items = items[0:i]
-				break
-			}
-		}
-	}
-
-	if !endDate.IsZero() {
-		log.Printf("Filtering out records after %v...\n", endDate)
-		for i := range items {
-			iDate := time.Date(items[i].Year, time.Month(items[i].Month),
-				items[i].Day, items[i].Hour, items[i].Minute, 0, 0,
-				time.Local)
-			if iDate.Sub(endDate) <= 0 {
-				items = items[i:]
-				break
-			}
-		}
+	if *userFlag != "all" {
+		userID, _ := strconv.Atoi(*userFlag)
+		items = filterByUser(items, userID)
 	}
 
-	if *fromTime != "" || *toTime != "" {
-		log.Println("Filtering hours...")
-
-		compare := func(m measurement, t simpleTime) int {
-			if m.Hour*60+m.Minute < t.hour*60+t.minute {
-				return -1
-			}
-			if m.Hour*60+m.Minute > t.hour*60+t.minute {
-				return 1
-			}
-			return 0
-		}
-
-		inv := false
-		if *fromTime != "" && *toTime != "" &&
-			startTime.hour*60+startTime.minute > endTime.hour*60+endTime.minute {
-			inv = true
-		}
+	// Apply filters
 
-		var newItems []measurement
-		for _, data := range items {
-			if inv {
-				if compare(data, startTime) == -1 && compare(data, endTime) == 1 {
-					continue
-				}
-				newItems = append(newItems, data)
-				continue
-			}
-			if *fromTime != "" && compare(data, startTime) == -1 {
-				continue
-			}
-			if *toTime != "" && compare(data, endTime) == 1 {
-				continue
-			}
-			newItems = append(newItems, data)
-		}
-		items = newItems
+	spec := FilterSpec{FromDate: startDate, ToDate: endDate, Limit: *limit}
+	if *fromTime != "" {
+		spec.FromTime, spec.HasFromTime = startTime, true
 	}
-
-	if *limit > 0 && len(items) > int(*limit) {
-		items = items[0:*limit]
+	if *toTime != "" {
+		spec.ToTime, spec.HasToTime = endTime, true
 	}
 
+	ds := NewDataset(items).Filter(spec)
+	items = ds.Items()
+
 	// Done with filtering
 
 	if *format == "csv" {
-		for i, data := range items {
-			fmt.Printf("%d;%x;%d-%02d-%02d %02d:%02d;%d;%d;%d",
-				i+1, data.Header,
-				data.Year, data.Month, data.Day,
-				data.Hour, data.Minute,
-				data.Systolic, data.Diastolic, data.Pulse)
-			if *whoClass {
-				fmt.Printf(";%s", data.WHOClassString())
-			}
-			fmt.Println()
-		}
+		writeCSV(os.Stdout, items, *whoClass)
 	}
 
 	if *stats {
@@ -688,7 +778,7 @@ func main() {
 	}
 
 	if *avg && len(items) > 0 {
-		avgMeasure, err := average(items)
+		avgMeasure, err := ds.Average()
 		if err != nil {
 			log.Println("Error:", err)
 		} else {
@@ -704,7 +794,7 @@ func main() {
 	}
 
 	if *stats && len(items) > 1 {
-		d, err := stdDeviation(items)
+		d, err := ds.StdDeviation()
 		if err != nil {
 			log.Println("Error:", err)
 		} else {
@@ -720,7 +810,7 @@ func main() {
 		}
 	}
 	if *stats && len(items) > 0 {
-		m, err := median(items)
+		m, err := ds.Median()
 		if err != nil {
 			log.Println("Error:", err)
 		} else {
@@ -733,12 +823,16 @@ func main() {
 		}
 
 		if *whoClass {
-			displayWHOClassStats(items)
+			displayWHOClassStats(ds.WHOStats())
+		}
+
+		if *userFlag == "all" {
+			displayPerUserStats(items, *whoClass)
 		}
 	}
 
 	if *format == "json" || *outFile != "" {
-		rawJSON, err := json.MarshalIndent(items, "", "  ")
+		rawJSON, err := json.MarshalIndent(jsonFile{Version: jsonFileVersion, Records: items}, "", "  ")
 		if err != nil {
 			log.Fatal("Error:", err)
 		}
@@ -753,4 +847,63 @@ func main() {
 			}
 		}
 	}
+
+	if *rrdFile != "" {
+		if err := updateRRD(*rrdFile, items); err != nil {
+			log.Fatal("Could not update RRD file: ", err)
+		}
+	}
+
+	if *rrdGraph != "" {
+		if *rrdFile == "" {
+			log.Fatal("--rrd-graph requires --rrd")
+		}
+		graphStart, graphEnd := startDate, endDate
+		if graphStart.IsZero() {
+			graphStart = time.Now().AddDate(0, -1, 0)
+		}
+		if graphEnd.IsZero() {
+			graphEnd = time.Now()
+		}
+		store := storage.NewRRDStore(*rrdFile)
+		if err := store.Graph(*rrdGraph, graphStart, graphEnd); err != nil {
+			log.Fatal("Could not create RRD graph: ", err)
+		}
+	}
+}
+
+// updateRRD stores items in the RRD file at path, creating it first if it
+// does not exist yet.
+func updateRRD(path string, items []measurement) error {
+	store := storage.NewRRDStore(path)
+
+	// items is sorted most-recent-first (as produced by mergeItems), but
+	// RRDs require strictly increasing timestamps, so build records
+	// oldest-first.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		start := time.Now().Add(-time.Hour)
+		if len(items) > 0 {
+			oldest := items[len(items)-1]
+			start = time.Date(oldest.Year, time.Month(oldest.Month),
+				oldest.Day, oldest.Hour, oldest.Minute, 0, 0,
+				time.Local).Add(-storage.Step * time.Second)
+		}
+		if err := store.Create(start); err != nil {
+			return err
+		}
+	}
+
+	records := make([]storage.Record, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		it := items[i]
+		records[len(items)-1-i] = storage.Record{
+			Time: time.Date(it.Year, time.Month(it.Month), it.Day,
+				it.Hour, it.Minute, 0, 0, time.Local),
+			Systolic:  it.Systolic,
+			Diastolic: it.Diastolic,
+			Pulse:     it.Pulse,
+		}
+	}
+
+	return store.Update(records)
 }
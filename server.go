@@ -0,0 +1,332 @@
+// Copyright (C) 2015-2017 Mikael Berthe <mikael@lilotux.net>. All rights reserved.
+// Use of this source code is governed by the MIT license,
+// which can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// recentReadings is the number of recent readings summarized by the
+// bm65_*_recent metrics exposed on /metrics.
+const recentReadings = 20
+
+// Server holds the in-memory dataset exposed by --serve mode.  It is
+// safe for concurrent use: the polling goroutine merges new readings in
+// while HTTP handlers read a consistent snapshot.
+type Server struct {
+	mu      sync.RWMutex
+	dataset *Dataset
+
+	device string
+}
+
+// NewServer returns a Server polling device and serving the given
+// initial dataset.
+func NewServer(device string, initial *Dataset) *Server {
+	return &Server{dataset: initial, device: device}
+}
+
+// Dataset returns the server's current dataset.
+func (srv *Server) Dataset() *Dataset {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.dataset
+}
+
+// Merge merges items into the server's dataset.
+func (srv *Server) Merge(items []measurement) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// mergeItems sorts its arguments in place: merge a copy so that the
+	// current snapshot, possibly being read by a handler, is left intact.
+	old := append([]measurement(nil), srv.dataset.Items()...)
+	srv.dataset = NewDataset(mergeItems(items, old))
+}
+
+// poll periodically reads the device and merges the results into the
+// server's dataset until the process exits.
+func (srv *Server) poll(interval time.Duration) {
+	for {
+		items, err := fetchData(srv.device, []int{1, 2})
+		if err != nil {
+			log.Println("Poll error:", err)
+		} else {
+			srv.Merge(items)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// filterSpecFromRequest builds a FilterSpec from the query parameters of
+// an HTTP request, mirroring the CLI's --since, --to-date, --from-time,
+// --to-time and --limit flags.
+func filterSpecFromRequest(r *http.Request) (spec FilterSpec, err error) {
+	q := r.URL.Query()
+
+	if v := q.Get("since"); v != "" {
+		if spec.FromDate, err = parseDate(v); err != nil {
+			return spec, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if v := q.Get("to-date"); v != "" {
+		if spec.ToDate, err = parseDate(v); err != nil {
+			return spec, fmt.Errorf("invalid to-date: %v", err)
+		}
+	}
+	if v := q.Get("from-time"); v != "" {
+		if spec.FromTime, err = parseTime(v); err != nil {
+			return spec, fmt.Errorf("invalid from-time: %v", err)
+		}
+		spec.HasFromTime = true
+	}
+	if v := q.Get("to-time"); v != "" {
+		if spec.ToTime, err = parseTime(v); err != nil {
+			return spec, fmt.Errorf("invalid to-time: %v", err)
+		}
+		spec.HasToTime = true
+	}
+	if v := q.Get("limit"); v != "" {
+		n, e := strconv.ParseUint(v, 10, 32)
+		if e != nil {
+			return spec, fmt.Errorf("invalid limit: %v", e)
+		}
+		spec.Limit = uint(n)
+	}
+
+	return spec, nil
+}
+
+func (srv *Server) handleRecords(w http.ResponseWriter, r *http.Request) {
+	spec, err := filterSpecFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := srv.Dataset().Filter(spec).Items()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		log.Println("Error encoding records:", err)
+	}
+}
+
+func (srv *Server) handleRecordsCSV(w http.ResponseWriter, r *http.Request) {
+	spec, err := filterSpecFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := srv.Dataset().Filter(spec).Items()
+	w.Header().Set("Content-Type", "text/csv")
+	writeCSV(w, items, r.URL.Query().Get("class") != "")
+}
+
+// statsResponse is the JSON payload returned by /stats.
+type statsResponse struct {
+	Average      measurement     `json:"average"`
+	Median       measurement     `json:"median"`
+	StdDeviation measurement     `json:"std_deviation"`
+	WHOClass     *WHOStatsResult `json:"who_class,omitempty"`
+}
+
+func (srv *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	spec, err := filterSpecFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ds := srv.Dataset().Filter(spec)
+	if len(ds.Items()) == 0 {
+		// An empty dataset isn't a bad request: it's a server started
+		// before the first successful poll, or a filter that legitimately
+		// matches nothing.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var resp statsResponse
+
+	if resp.Average, err = ds.Average(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Median, _ = ds.Median()
+	resp.StdDeviation, _ = ds.StdDeviation()
+
+	if r.URL.Query().Get("class") == "1" {
+		who := ds.WHOStats()
+		resp.WHOClass = &who
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println("Error encoding stats:", err)
+	}
+}
+
+func (srv *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := decodeJSONRecords(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv.Merge(items)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bm65Users are the device's two user slots, plus 0 for records that
+// carry no user tag (legacy version 1 archives are tagged as user 1 on
+// load, but a versioned archive or import may omit the User field).
+var bm65Users = []int{1, 2, 0}
+
+func (srv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	items := srv.Dataset().Items()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP bm65_systolic_mmhg Latest systolic blood pressure reading, per user.")
+	fmt.Fprintln(w, "# TYPE bm65_systolic_mmhg gauge")
+	fmt.Fprintln(w, "# HELP bm65_diastolic_mmhg Latest diastolic blood pressure reading, per user.")
+	fmt.Fprintln(w, "# TYPE bm65_diastolic_mmhg gauge")
+	fmt.Fprintln(w, "# HELP bm65_pulse_bpm Latest pulse reading, per user.")
+	fmt.Fprintln(w, "# TYPE bm65_pulse_bpm gauge")
+	for _, user := range bm65Users {
+		userItems := filterByUser(items, user)
+		if len(userItems) == 0 {
+			continue
+		}
+		label := strconv.Itoa(user)
+		latest := userItems[0] // items are sorted most-recent-first
+		fmt.Fprintf(w, "bm65_systolic_mmhg{user=%q} %d\n", label, latest.Systolic)
+		fmt.Fprintf(w, "bm65_diastolic_mmhg{user=%q} %d\n", label, latest.Diastolic)
+		fmt.Fprintf(w, "bm65_pulse_bpm{user=%q} %d\n", label, latest.Pulse)
+	}
+
+	fmt.Fprintf(w, "# HELP bm65_systolic_mmhg_recent Summary of the last %d systolic readings, per user.\n", recentReadings)
+	fmt.Fprintln(w, "# TYPE bm65_systolic_mmhg_recent summary")
+	fmt.Fprintf(w, "# HELP bm65_diastolic_mmhg_recent Summary of the last %d diastolic readings, per user.\n", recentReadings)
+	fmt.Fprintln(w, "# TYPE bm65_diastolic_mmhg_recent summary")
+	fmt.Fprintf(w, "# HELP bm65_pulse_bpm_recent Summary of the last %d pulse readings, per user.\n", recentReadings)
+	fmt.Fprintln(w, "# TYPE bm65_pulse_bpm_recent summary")
+	for _, user := range bm65Users {
+		userItems := filterByUser(items, user)
+		if len(userItems) == 0 {
+			continue
+		}
+		label := strconv.Itoa(user)
+		n := len(userItems)
+		if n > recentReadings {
+			n = recentReadings
+		}
+		writeRecentSummary(w, "bm65_systolic_mmhg_recent", label, systolicOf(userItems[:n]))
+		writeRecentSummary(w, "bm65_diastolic_mmhg_recent", label, diastolicOf(userItems[:n]))
+		writeRecentSummary(w, "bm65_pulse_bpm_recent", label, pulseOf(userItems[:n]))
+	}
+
+	fmt.Fprintln(w, "# HELP bm65_who_class WHO blood pressure classification of the latest reading, per user.")
+	fmt.Fprintln(w, "# TYPE bm65_who_class gauge")
+	for _, user := range bm65Users {
+		userItems := filterByUser(items, user)
+		if len(userItems) == 0 {
+			continue
+		}
+		class, _ := userItems[0].WHOClass()
+		fmt.Fprintf(w, "bm65_who_class{user=%q} %d\n", strconv.Itoa(user), class)
+	}
+}
+
+func systolicOf(items []measurement) []int {
+	v := make([]int, len(items))
+	for i, m := range items {
+		v[i] = m.Systolic
+	}
+	return v
+}
+
+func diastolicOf(items []measurement) []int {
+	v := make([]int, len(items))
+	for i, m := range items {
+		v[i] = m.Diastolic
+	}
+	return v
+}
+
+func pulseOf(items []measurement) []int {
+	v := make([]int, len(items))
+	for i, m := range items {
+		v[i] = m.Pulse
+	}
+	return v
+}
+
+// writeRecentSummary writes the data lines of a Prometheus summary
+// (0.5 and 0.9 quantiles, sum and count) for the given recent values.  The caller is
+// expected to have already written the metric's HELP/TYPE header.
+func writeRecentSummary(w http.ResponseWriter, name, user string, values []int) {
+	if len(values) == 0 {
+		return
+	}
+
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+
+	sum := 0
+	for _, v := range sorted {
+		sum += v
+	}
+
+	fmt.Fprintf(w, "%s{quantile=\"0.5\",user=%q} %d\n", name, user, intMedian(sorted))
+	fmt.Fprintf(w, "%s{quantile=\"0.9\",user=%q} %d\n", name, user, sorted[(len(sorted)*9)/10])
+	fmt.Fprintf(w, "%s_sum{user=%q} %d\n", name, user, sum)
+	fmt.Fprintf(w, "%s_count{user=%q} %d\n", name, user, len(sorted))
+}
+
+// runServer starts gobm65 in HTTP server mode: it loads the optional
+// input file(s) as a starting dataset, polls device every interval,
+// and serves the REST and Prometheus endpoints on addr until the
+// process is killed.
+func runServer(addr, device, inFile string, interval time.Duration) {
+	var items []measurement
+	if inFile != "" {
+		var err error
+		if items, err = loadFromJSONFiles(inFile); err != nil {
+			log.Fatal("Could not load input file(s): ", err)
+		}
+	}
+
+	srv := NewServer(device, NewDataset(items))
+
+	go srv.poll(interval)
+
+	http.HandleFunc("/records", srv.handleRecords)
+	http.HandleFunc("/records.csv", srv.handleRecordsCSV)
+	http.HandleFunc("/stats", srv.handleStats)
+	http.HandleFunc("/import", srv.handleImport)
+	http.HandleFunc("/metrics", srv.handleMetrics)
+
+	log.Printf("Listening on %s...\n", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
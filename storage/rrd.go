@@ -0,0 +1,129 @@
+// Copyright (C) 2015-2017 Mikael Berthe <mikael@lilotux.net>. All rights reserved.
+// Use of this source code is governed by the MIT license,
+// which can be found in the LICENSE file.
+
+// Package storage provides long-term storage of gobm65 measurements in
+// round-robin databases (RRD), suitable for graphing with rrdtool.
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ziutek/rrd"
+)
+
+// Step is the RRD base step, in seconds.  It should be small enough that
+// two real-world measurements taken on the same day do not land in the
+// same slot.
+const Step = 300
+
+// Record is a single time-stamped blood pressure sample to be stored in
+// an RRD file.
+type Record struct {
+	Time      time.Time
+	Systolic  int
+	Diastolic int
+	Pulse     int
+}
+
+// RRDStore wraps an RRD file used for long-term storage of blood
+// pressure measurements.
+type RRDStore struct {
+	Path string
+}
+
+// NewRRDStore returns an RRDStore bound to the given RRD file path.
+func NewRRDStore(path string) *RRDStore {
+	return &RRDStore{Path: path}
+}
+
+// Create creates a new RRD file with systolic, diastolic and pulse
+// gauges, and AVERAGE/MIN/MAX archives covering a day, a week, a month
+// and a year.
+func (s *RRDStore) Create(start time.Time) error {
+	c := rrd.NewCreator(s.Path, start, Step)
+
+	c.DS("systolic", "GAUGE", 2*Step, 0, 300)
+	c.DS("diastolic", "GAUGE", 2*Step, 0, 300)
+	c.DS("pulse", "GAUGE", 2*Step, 0, 250)
+
+	// 1 day at the base (5mn) resolution.
+	c.RRA("AVERAGE", 0.5, 1, 288)
+	c.RRA("MIN", 0.5, 1, 288)
+	c.RRA("MAX", 0.5, 1, 288)
+	// 1 week at 30mn resolution.
+	c.RRA("AVERAGE", 0.5, 6, 336)
+	c.RRA("MIN", 0.5, 6, 336)
+	c.RRA("MAX", 0.5, 6, 336)
+	// 1 month at 2h resolution.
+	c.RRA("AVERAGE", 0.5, 24, 372)
+	c.RRA("MIN", 0.5, 24, 372)
+	c.RRA("MAX", 0.5, 24, 372)
+	// 1 year at 1-day resolution.
+	c.RRA("AVERAGE", 0.5, 288, 365)
+	c.RRA("MIN", 0.5, 288, 365)
+	c.RRA("MAX", 0.5, 288, 365)
+
+	return c.Create(false)
+}
+
+// isLater reports whether t is strictly after last.
+func isLater(t, last time.Time) bool {
+	return t.After(last)
+}
+
+// Update pushes records into the RRD, skipping any record that is not
+// strictly later than the RRD's last update time.  Records are expected
+// in chronological order.
+func (s *RRDStore) Update(records []Record) error {
+	info, err := rrd.Info(s.Path)
+	if err != nil {
+		return fmt.Errorf("cannot read RRD info: %v", err)
+	}
+
+	raw, ok := info["last_update"]
+	if !ok {
+		return fmt.Errorf("cannot find last_update in RRD info")
+	}
+
+	var lastUpdate time.Time
+	switch v := raw.(type) {
+	case uint:
+		lastUpdate = time.Unix(int64(v), 0)
+	case int64:
+		lastUpdate = time.Unix(v, 0)
+	default:
+		return fmt.Errorf("unexpected type for last_update: %T", v)
+	}
+
+	u := rrd.NewUpdater(s.Path)
+	for _, r := range records {
+		if !isLater(r.Time, lastUpdate) {
+			continue
+		}
+		if err := u.Update(r.Time, r.Systolic, r.Diastolic, r.Pulse); err != nil {
+			return fmt.Errorf("rrd update failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// Graph renders a systolic/diastolic/pulse line chart covering [start,
+// end] to a PNG file.
+func (s *RRDStore) Graph(pngPath string, start, end time.Time) error {
+	g := rrd.NewGrapher()
+	g.SetTitle("Blood pressure")
+	g.SetVLabel("mmHg / bpm")
+
+	g.Def("sys", s.Path, "systolic", "AVERAGE")
+	g.Def("dia", s.Path, "diastolic", "AVERAGE")
+	g.Def("pul", s.Path, "pulse", "AVERAGE")
+
+	g.Line(1, "sys", "FF0000", "Systolic")
+	g.Line(1, "dia", "0000FF", "Diastolic")
+	g.Line(1, "pul", "00AA00", "Pulse")
+
+	_, err := g.SaveGraph(pngPath, start, end)
+	return err
+}